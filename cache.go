@@ -0,0 +1,107 @@
+package mdns
+
+import "time"
+
+// cacheSweepInterval is how often sweepCache drops expired entries.
+const cacheSweepInterval = time.Minute
+
+// recordKey identifies a cached or outstanding single-valued record by
+// name and type, since the same name can carry an A, SRV, TXT, etc.
+// answer. PTR answers aren't single-valued -- a service name can list
+// many instances -- so they're cached separately in ptrCache, keyed by
+// (name, instance) instead of overwriting each other.
+type recordKey struct {
+	name string
+	typ  uint16
+}
+
+// ptrKey identifies one instance advertised under a PTR name.
+type ptrKey struct {
+	name     string
+	instance string
+}
+
+type cacheEntry struct {
+	answer Answer
+	expire time.Time
+}
+
+// cacheGet returns a cached, unexpired answer for key, if any. Callers
+// must hold c.mu.
+func (c *Conn) cacheGet(key recordKey) (Answer, bool) {
+	entry, ok := c.cache[key]
+	if !ok || time.Now().After(entry.expire) {
+		return Answer{}, false
+	}
+	return entry.answer, true
+}
+
+// cachePTRGet returns every cached, unexpired instance advertised under
+// name. Callers must hold c.mu.
+func (c *Conn) cachePTRGet(name string) []Answer {
+	var answers []Answer
+	now := time.Now()
+	for key, entry := range c.ptrCache {
+		if key.name == name && now.Before(entry.expire) {
+			answers = append(answers, entry.answer)
+		}
+	}
+	return answers
+}
+
+// cacheStore records a's answer, or evicts any cached entry for it
+// immediately when a.TTL is zero (an RFC 6762 section 10.1 "goodbye"
+// record). PTR answers are stored in ptrCache, keyed by (name,
+// instance), since overwriting by name alone would drop every instance
+// but the most recently seen. Callers must hold c.mu.
+func (c *Conn) cacheStore(a *Answer) {
+	if a.Type == typePTR {
+		key := ptrKey{a.Name, a.PTR}
+		if a.TTL == 0 {
+			delete(c.ptrCache, key)
+			return
+		}
+		c.ptrCache[key] = cacheEntry{
+			answer: *a,
+			expire: time.Now().Add(time.Duration(a.TTL) * time.Second),
+		}
+		return
+	}
+
+	key := recordKey{a.Name, a.Type}
+	if a.TTL == 0 {
+		delete(c.cache, key)
+		return
+	}
+	c.cache[key] = cacheEntry{
+		answer: *a,
+		expire: time.Now().Add(time.Duration(a.TTL) * time.Second),
+	}
+}
+
+// sweepCache periodically drops expired cache entries so the maps
+// don't grow without bound. It exits once c is closed.
+func (c *Conn) sweepCache() {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closed:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for key, entry := range c.cache {
+				if now.After(entry.expire) {
+					delete(c.cache, key)
+				}
+			}
+			for key, entry := range c.ptrCache {
+				if now.After(entry.expire) {
+					delete(c.ptrCache, key)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package mdns
+
+import (
+	"net"
+	"time"
+)
+
+// Config customizes the behavior of a Conn returned by Server.
+type Config struct {
+	// QueryInterval is how often an outstanding Query retransmits its
+	// question while waiting for an answer. Defaults to one second.
+	QueryInterval time.Duration
+
+	// LocalNames lists the names this Conn should answer for when it
+	// receives a matching question. Leave empty to run in query-only
+	// mode.
+	LocalNames []string
+
+	// Interfaces restricts which network interfaces Server joins the
+	// mDNS multicast groups on. Leave empty to join every up,
+	// non-loopback, non-point-to-point interface.
+	Interfaces []net.Interface
+
+	// IPv4Only disables the IPv6 socket passed to Server even if one
+	// was supplied. Mutually exclusive with IPv6Only.
+	IPv4Only bool
+
+	// IPv6Only disables the IPv4 socket passed to Server even if one
+	// was supplied. Mutually exclusive with IPv4Only.
+	IPv6Only bool
+
+	// Logger receives diagnostic messages from the Conn. Defaults to
+	// slog.Default() when nil.
+	Logger Logger
+
+	// DisableUnsolicitedFilter disables the default filtering of
+	// cross-subnet and unsolicited answers. Hosts with a VPN interface
+	// routinely see mDNS traffic forwarded from an entirely different
+	// subnet, so by default Conn drops any answer whose source isn't in
+	// the same subnet as the interface it arrived on, and any answer
+	// that isn't a reply to an outstanding query or a genuine multicast
+	// announcement (AA and QR set, no questions). Set this to restore
+	// the old first-answer-wins behavior.
+	DisableUnsolicitedFilter bool
+}
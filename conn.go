@@ -2,25 +2,41 @@ package mdns
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
 
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 // Conn represents a mDNS Server
 type Conn struct {
 	mu sync.RWMutex
 
-	socket  *ipv4.PacketConn
-	dstAddr *net.UDPAddr
+	socket4  *ipv4.PacketConn
+	socket6  *ipv6.PacketConn
+	dstAddr4 *net.UDPAddr
+	dstAddr6 *net.UDPAddr
+	ifaces   []net.Interface
 
-	queryInterval time.Duration
-	localNames    []string
-	queries       map[string]chan queryResult
+	logger    Logger
+	errCh     chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	queryInterval     time.Duration
+	localNames        []string
+	queries           map[recordKey][]chan queryResult
+	cache             map[recordKey]cacheEntry
+	ptrCache          map[ptrKey]cacheEntry
+	unsolicitedFilter bool
+
+	services       []service
+	serviceQueries map[string][]chan *Answer
 }
 
 type queryResult struct {
@@ -30,70 +46,186 @@ type queryResult struct {
 
 const (
 	inboundBufferSize    = 512
+	errChBufferSize      = 16
 	defaultQueryInterval = time.Second
-	destinationAddress   = "224.0.0.251:5353"
+	defaultAnswerTTL     = 120
+	defaultServiceTTL    = 4500
+	destinationAddressV4 = "224.0.0.251:5353"
+	destinationAddressV6 = "[ff02::fb]:5353"
 )
 
-// Server establishes a mDNS connection over an existing conn
-func Server(conn *ipv4.PacketConn, config *Config) (*Conn, error) {
-	ifaces, err := net.Interfaces()
+// Server establishes a mDNS connection over existing IPv4 and/or IPv6
+// sockets. Either conn may be nil to disable that address family, and
+// Config.IPv4Only / Config.IPv6Only force a single family even when
+// both sockets are supplied. Config.Interfaces restricts which
+// interfaces the group is joined on; when it's empty, Server joins
+// every up, non-loopback, non-point-to-point interface, since blasting
+// every interface (including VPN tunnels) is how hosts end up seeing
+// answers from the wrong subnet.
+func Server(v4Conn *ipv4.PacketConn, v6Conn *ipv6.PacketConn, config *Config) (*Conn, error) {
+	if v4Conn == nil && v6Conn == nil {
+		return nil, errors.New("mdns: at least one of v4Conn, v6Conn must be non-nil")
+	}
+
+	v4Only := config != nil && config.IPv4Only
+	v6Only := config != nil && config.IPv6Only
+	if v4Only && v6Only {
+		return nil, errors.New("mdns: Config.IPv4Only and Config.IPv6Only are mutually exclusive")
+	}
+
+	ifaces, err := selectInterfaces(config)
 	if err != nil {
 		return nil, err
 	}
 
-	for i := range ifaces {
-		if err = conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251)}); err != nil {
+	c := &Conn{
+		logger:            slog.Default(),
+		errCh:             make(chan error, errChBufferSize),
+		closed:            make(chan struct{}),
+		queryInterval:     defaultQueryInterval,
+		queries:           map[recordKey][]chan queryResult{},
+		cache:             map[recordKey]cacheEntry{},
+		ptrCache:          map[ptrKey]cacheEntry{},
+		unsolicitedFilter: true,
+		serviceQueries:    map[string][]chan *Answer{},
+		ifaces:            ifaces,
+	}
+
+	if v4Conn != nil && !v6Only {
+		for i := range ifaces {
+			if err := v4Conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251)}); err != nil {
+				return nil, err
+			}
+		}
+		// We need to know which interface a query arrived on so the
+		// responder can answer with an address that's actually
+		// reachable from the querier.
+		if err := v4Conn.SetControlMessage(ipv4.FlagInterface, true); err != nil {
 			return nil, err
 		}
+		dstAddr4, err := net.ResolveUDPAddr("udp4", destinationAddressV4)
+		if err != nil {
+			return nil, err
+		}
+		c.socket4 = v4Conn
+		c.dstAddr4 = dstAddr4
 	}
 
-	dstAddr, err := net.ResolveUDPAddr("udp", destinationAddress)
-	if err != nil {
-		return nil, err
-
+	if v6Conn != nil && !v4Only {
+		for i := range ifaces {
+			if err := v6Conn.JoinGroup(&ifaces[i], &net.UDPAddr{IP: net.ParseIP("ff02::fb")}); err != nil {
+				return nil, err
+			}
+		}
+		if err := v6Conn.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+			return nil, err
+		}
+		dstAddr6, err := net.ResolveUDPAddr("udp6", destinationAddressV6)
+		if err != nil {
+			return nil, err
+		}
+		c.socket6 = v6Conn
+		c.dstAddr6 = dstAddr6
 	}
 
-	c := &Conn{
-		queryInterval: defaultQueryInterval,
-		queries:       map[string]chan queryResult{},
-		socket:        conn,
-		dstAddr:       dstAddr,
+	if c.socket4 == nil && c.socket6 == nil {
+		return nil, errors.New("mdns: no usable socket (check Config.IPv4Only/IPv6Only against the sockets passed in)")
 	}
+
 	if config != nil {
 		if config.QueryInterval != 0 {
 			c.queryInterval = config.QueryInterval
 		}
+		if config.Logger != nil {
+			c.logger = config.Logger
+		}
+		if config.DisableUnsolicitedFilter {
+			c.unsolicitedFilter = false
+		}
 		c.localNames = append([]string(nil), config.LocalNames...)
 	}
 
-	go c.start()
+	c.start()
+	go c.sweepCache()
 	return c, nil
 }
 
+// selectInterfaces returns the interfaces Server should join the mDNS
+// multicast groups on.
+func selectInterfaces(config *Config) ([]net.Interface, error) {
+	if config != nil && len(config.Interfaces) > 0 {
+		return config.Interfaces, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var ifaces []net.Interface
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if iface.Flags&net.FlagPointToPoint != 0 {
+			continue
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
 // Query sends mDNS Queries for the following name until
 // either the Context is canceled/expires or we get a result
 func (c *Conn) Query(ctx context.Context, name string) (Answer, net.Addr) {
-	queryChan := make(chan queryResult, 1)
+	return c.queryType(ctx, name, typeA)
+}
+
+// queryType is Query generalized to record types other than A, used
+// internally by QueryService to look up SRV/TXT/AAAA records.
+func (c *Conn) queryType(ctx context.Context, name string, recordType uint16) (Answer, net.Addr) {
+	select {
+	case <-c.closed:
+		return Answer{}, nil
+	default:
+	}
+
+	key := recordKey{name, recordType}
+
 	c.mu.Lock()
-	c.queries[name] = queryChan
+	if answer, ok := c.cacheGet(key); ok {
+		// The sender's address isn't cached, only the answer.
+		c.mu.Unlock()
+		return answer, nil
+	}
+	queryChan := make(chan queryResult, 1)
+	c.queries[key] = append(c.queries[key], queryChan)
 	ticker := time.NewTicker(c.queryInterval)
 	c.mu.Unlock()
 
+	defer func() {
+		c.mu.Lock()
+		c.removeSubscriber(key, queryChan)
+		c.mu.Unlock()
+	}()
+
 	sendQuery := func() {
 		query := packet{
 			questions: []*Question{
-				{Name: name, Type: 0x01, Class: 0x01},
+				{Name: name, Type: recordType, Class: classIN},
 			},
 		}
 
 		rawQuery, err := query.Marshal()
 		if err != nil {
-			log.Fatal(err)
+			c.reportErr(fmt.Errorf("mdns: marshal query: %w", err))
+			return
 		}
 
-		if _, err := c.socket.WriteTo(rawQuery, nil, c.dstAddr); err != nil {
-			log.Fatal(err)
-		}
+		c.writeAll(rawQuery)
 	}
 	sendQuery()
 
@@ -108,37 +240,342 @@ func (c *Conn) Query(ctx context.Context, name string) (Answer, net.Addr) {
 			return res.answer, res.addr
 		case <-ctx.Done():
 			return Answer{}, nil
+		case <-c.closed:
+			return Answer{}, nil
+		}
+	}
+}
+
+// writeAll transmits raw once per joined interface on every joined
+// multicast socket, pinning each transmission's egress interface via
+// the control message. Without that, the kernel picks the outgoing
+// interface from its default route, so Config.Interfaces would only
+// ever change what Server receives on, not what it sends on.
+func (c *Conn) writeAll(raw []byte) {
+	for _, iface := range c.ifaces {
+		if c.socket4 != nil {
+			cm := &ipv4.ControlMessage{IfIndex: iface.Index}
+			if _, err := c.socket4.WriteTo(raw, cm, c.dstAddr4); err != nil {
+				c.reportErr(fmt.Errorf("mdns: write to v4 socket on %s: %w", iface.Name, err))
+			}
+		}
+		if c.socket6 != nil {
+			cm := &ipv6.ControlMessage{IfIndex: iface.Index}
+			if _, err := c.socket6.WriteTo(raw, cm, c.dstAddr6); err != nil {
+				c.reportErr(fmt.Errorf("mdns: write to v6 socket on %s: %w", iface.Name, err))
+			}
 		}
 	}
 }
 
+// reportErr logs err and, if anyone is listening, delivers it on the
+// channel returned by Errors. It never blocks.
+func (c *Conn) reportErr(err error) {
+	c.logger.Error(err.Error())
+	select {
+	case c.errCh <- err:
+	default:
+	}
+}
+
+// Errors returns a channel of asynchronous failures from the reader and
+// responder paths, such as a failed read or write. Unparseable packets
+// are only logged, not delivered here.
+// Callers that don't need to observe these may leave it unread.
+func (c *Conn) Errors() <-chan error {
+	return c.errCh
+}
+
+// Close stops c's reader goroutines, closes its sockets, and unblocks
+// any in-flight Query/QueryService calls. It is safe to call more than
+// once.
+func (c *Conn) Close() error {
+	var closeErr error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		c.mu.Lock()
+		for key, subs := range c.queries {
+			for _, ch := range subs {
+				close(ch)
+			}
+			delete(c.queries, key)
+		}
+		c.mu.Unlock()
+
+		if c.socket4 != nil {
+			if err := c.socket4.Close(); err != nil {
+				closeErr = err
+			}
+		}
+		if c.socket6 != nil {
+			if err := c.socket6.Close(); err != nil && closeErr == nil {
+				closeErr = err
+			}
+		}
+	})
+	return closeErr
+}
+
+// start launches one reader goroutine per joined socket; both feed the
+// same dispatch path in handlePacket.
 func (c *Conn) start() {
+	if c.socket4 != nil {
+		go c.readLoopV4()
+	}
+	if c.socket6 != nil {
+		go c.readLoopV6()
+	}
+}
+
+func (c *Conn) readLoopV4() {
 	b := make([]byte, inboundBufferSize)
-	pkt := packet{}
+	for {
+		n, cm, src, err := c.socket4.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c.reportErr(fmt.Errorf("mdns: read from v4 socket: %w", err))
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
+		}
+		c.handlePacket(b[:n], ifIndex, src, c.dstAddr4, c.socket4.WriteTo)
+	}
+}
 
+func (c *Conn) readLoopV6() {
+	b := make([]byte, inboundBufferSize)
 	for {
-		n, _, src, err := c.socket.ReadFrom(b)
+		n, cm, src, err := c.socket6.ReadFrom(b)
 		if err != nil {
-			log.Fatal("Read failed:", err)
-			// TODO cleanup
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c.reportErr(fmt.Errorf("mdns: read from v6 socket: %w", err))
+			continue
+		}
+		ifIndex := 0
+		if cm != nil {
+			ifIndex = cm.IfIndex
 		}
+		c.handlePacket(b[:n], ifIndex, src, c.dstAddr6, func(raw []byte, cm *ipv4.ControlMessage, dst net.Addr) (int, error) {
+			var cm6 *ipv6.ControlMessage
+			if cm != nil {
+				cm6 = &ipv6.ControlMessage{IfIndex: cm.IfIndex}
+			}
+			return c.socket6.WriteTo(raw, cm6, dst)
+		})
+	}
+}
 
-		func() {
-			c.mu.RLock()
-			defer c.mu.RUnlock()
+// handlePacket is the shared dispatch path for packets read off either
+// socket: it resolves outstanding Query/QueryService calls and, if the
+// packet carried questions, answers them via reply. Unless
+// Config.DisableUnsolicitedFilter was set, answers from the wrong
+// subnet are dropped outright, and answers that neither match an
+// outstanding query nor arrive as a genuine multicast announcement are
+// ignored rather than cached or delivered.
+func (c *Conn) handlePacket(b []byte, ifIndex int, src net.Addr, multicastDst *net.UDPAddr, reply func([]byte, *ipv4.ControlMessage, net.Addr) (int, error)) {
+	pkt := packet{}
+	if err := pkt.Unmarshal(b); err != nil {
+		// Traffic can be anything, so this is only logged as a warning
+		// and not reported on Errors.
+		c.logger.Warn("mdns: discarding unparseable packet", "error", err)
+		return
+	}
 
-			if err := pkt.Unmarshal(b[:n]); err != nil {
-				fmt.Println(err)
-				// Traffic can be anything, info at most
-				return
+	filter := c.unsolicitedFilter
+	announcement := filter && pkt.header.flags&flagQR != 0 && pkt.header.flags&flagAA != 0 && len(pkt.questions) == 0
+	sameSubnet := !filter || answerFromSameSubnet(ifIndex, src)
+
+	func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		for _, a := range pkt.answers {
+			if filter && !sameSubnet {
+				continue
+			}
+
+			key := recordKey{a.Name, a.Type}
+			subs, hasQuery := c.queries[key]
+			ptrSubs := c.serviceQueries[a.Name]
+			solicited := announcement || hasQuery || (a.Type == typePTR && len(ptrSubs) > 0)
+			if filter && !solicited {
+				continue
 			}
 
-			for _, a := range pkt.answers {
-				if resChan, ok := c.queries[a.Name]; ok {
-					resChan <- queryResult{*a, src}
-					delete(c.queries, a.Name)
+			c.cacheStore(a)
+
+			if hasQuery {
+				for _, ch := range subs {
+					select {
+					case ch <- queryResult{*a, src}:
+					default:
+					}
+				}
+				delete(c.queries, key)
+			}
+			if a.Type == typePTR {
+				for _, sub := range ptrSubs {
+					select {
+					case sub <- a:
+					default:
+					}
 				}
 			}
-		}()
+		}
+	}()
+
+	if len(pkt.questions) > 0 {
+		c.respond(pkt.questions, ifIndex, src, multicastDst, reply)
+	}
+}
+
+// respond answers any question in questions that matches one of
+// c.localNames or a service registered via RegisterService, replying
+// over the interface the query arrived on. Per RFC 6762 section 18.12
+// the reply goes back to src unicast when the question has the QU bit
+// set, and to the multicast group otherwise.
+func (c *Conn) respond(questions []*Question, ifIndex int, src net.Addr, multicastDst *net.UDPAddr, reply func([]byte, *ipv4.ControlMessage, net.Addr) (int, error)) {
+	if ifIndex == 0 {
+		return
+	}
+
+	c.mu.RLock()
+	localNames := c.localNames
+	services := c.services
+	c.mu.RUnlock()
+	if len(localNames) == 0 && len(services) == 0 {
+		return
+	}
+
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return
+	}
+
+	var answers []*Answer
+	unicast := false
+
+	addAddrAnswers := func(name string) {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ip4 := ipNet.IP.To4(); ip4 != nil {
+				answers = append(answers, &Answer{Name: name, Type: typeA, Class: classIN, TTL: defaultAnswerTTL, IP: ip4})
+			} else if ipNet.IP.To16() != nil {
+				answers = append(answers, &Answer{Name: name, Type: typeAAAA, Class: classIN, TTL: defaultAnswerTTL, IP: ipNet.IP})
+			}
+		}
+	}
+
+	for _, q := range questions {
+		if q.unicastResponse() {
+			unicast = true
+		}
+		if containsName(localNames, q.Name) {
+			addAddrAnswers(q.Name)
+		}
+		for _, svc := range services {
+			fqdn := svc.fqdn()
+			switch q.Name {
+			case svc.service:
+				answers = append(answers, &Answer{Name: svc.service, Type: typePTR, Class: classIN, TTL: defaultServiceTTL, PTR: fqdn})
+			case fqdn:
+				answers = append(answers,
+					&Answer{Name: fqdn, Type: typeSRV, Class: classIN, TTL: defaultServiceTTL, SRV: &SRVRecord{Port: svc.port, Target: fqdn}},
+					&Answer{Name: fqdn, Type: typeTXT, Class: classIN, TTL: defaultServiceTTL, TXT: svc.txt},
+				)
+				addAddrAnswers(fqdn)
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	// QR marks this as a response and AA marks us authoritative for the
+	// records we're answering with, per RFC 6762 section 18.
+	replyPkt := packet{header: header{flags: flagQR | flagAA}, answers: answers}
+	raw, err := replyPkt.Marshal()
+	if err != nil {
+		c.reportErr(fmt.Errorf("mdns: marshal reply: %w", err))
+		return
+	}
+
+	dst := net.Addr(multicastDst)
+	if unicast {
+		dst = src
+	}
+	// Pin the reply to the interface the query arrived on; otherwise the
+	// kernel's default route may send it out a different link than the
+	// querier is actually reachable from.
+	if _, err := reply(raw, &ipv4.ControlMessage{IfIndex: ifIndex}, dst); err != nil {
+		c.reportErr(fmt.Errorf("mdns: write reply: %w", err))
+	}
+}
+
+// removeSubscriber drops ch from c.queries[key], cleaning up the map
+// entry once it's empty. Callers must hold c.mu.
+func (c *Conn) removeSubscriber(key recordKey, ch chan queryResult) {
+	subs := c.queries[key]
+	for i, sub := range subs {
+		if sub == ch {
+			c.queries[key] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(c.queries[key]) == 0 {
+		delete(c.queries, key)
+	}
+}
+
+// answerFromSameSubnet reports whether src is in the same subnet as one
+// of the addresses of the interface the packet arrived on. VPN tunnel
+// interfaces routinely forward mDNS traffic from an entirely different
+// subnet, so this rejects it rather than letting it masquerade as a
+// local answer; see Config.DisableUnsolicitedFilter. It fails open (true)
+// when the interface or its addresses can't be determined.
+func answerFromSameSubnet(ifIndex int, src net.Addr) bool {
+	if ifIndex == 0 {
+		return true
+	}
+	iface, err := net.InterfaceByIndex(ifIndex)
+	if err != nil {
+		return true
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return true
+	}
+	udpAddr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return true
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
 	}
+	return false
 }
@@ -0,0 +1,13 @@
+package mdns
+
+import "log/slog"
+
+// Logger receives diagnostic messages from a Conn. *slog.Logger
+// satisfies this interface, so callers can pass one directly via
+// Config.Logger; Server falls back to slog.Default() when none is set.
+type Logger interface {
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
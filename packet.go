@@ -0,0 +1,346 @@
+package mdns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Resource record types used by mDNS.
+const (
+	typeA    uint16 = 0x0001
+	typePTR  uint16 = 0x000c
+	typeTXT  uint16 = 0x0010
+	typeAAAA uint16 = 0x001c
+	typeSRV  uint16 = 0x0021
+)
+
+// classIN is the only resource record class mDNS uses.
+const classIN uint16 = 0x0001
+
+// Header flag bits (RFC 1035 section 4.1.1), used to recognize an
+// unsolicited multicast announcement: QR set (it's a response) and AA
+// set (the responder is authoritative for the records it carries).
+const (
+	flagQR uint16 = 0x8000
+	flagAA uint16 = 0x0400
+)
+
+// classUnicastBit is the high bit of a question's class field; when set
+// it asks the responder to reply via unicast instead of multicast (the
+// "QU" bit, RFC 6762 section 18.12).
+const classUnicastBit uint16 = 0x8000
+
+// Question is a single mDNS question.
+type Question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+func (q *Question) unicastResponse() bool {
+	return q.Class&classUnicastBit != 0
+}
+
+// Answer is a single mDNS resource record, either parsed from an
+// incoming packet or constructed by the responder. Only the field(s)
+// matching Type are populated.
+type Answer struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+
+	IP  net.IP     // typeA, typeAAAA
+	PTR string     // typePTR
+	SRV *SRVRecord // typeSRV
+	TXT []string   // typeTXT
+}
+
+// SRVRecord holds the rdata of an SRV resource record (RFC 2782).
+type SRVRecord struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+type header struct {
+	id      uint16
+	flags   uint16
+	qdCount uint16
+	anCount uint16
+	nsCount uint16
+	arCount uint16
+}
+
+type packet struct {
+	header    header
+	questions []*Question
+	answers   []*Answer
+}
+
+// Marshal encodes p into wire format. Names are written uncompressed;
+// mDNS packets are small enough that this isn't a practical concern.
+func (p *packet) Marshal() ([]byte, error) {
+	buf := make([]byte, 12)
+	binary.BigEndian.PutUint16(buf[0:2], p.header.id)
+	binary.BigEndian.PutUint16(buf[2:4], p.header.flags)
+	binary.BigEndian.PutUint16(buf[4:6], uint16(len(p.questions)))
+	binary.BigEndian.PutUint16(buf[6:8], uint16(len(p.answers)))
+	// NSCOUNT/ARCOUNT stay zero; we don't emit authority/additional records.
+
+	for _, q := range p.questions {
+		name, err := marshalName(q.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, name...)
+		buf = appendUint16(buf, q.Type)
+		buf = appendUint16(buf, q.Class)
+	}
+
+	for _, a := range p.answers {
+		name, err := marshalName(a.Name)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, name...)
+		buf = appendUint16(buf, a.Type)
+		buf = appendUint16(buf, a.Class)
+		buf = appendUint32(buf, a.TTL)
+
+		var rdata []byte
+		switch a.Type {
+		case typeA:
+			ip4 := a.IP.To4()
+			if ip4 == nil {
+				return nil, fmt.Errorf("mdns: A record %q has no IPv4 address", a.Name)
+			}
+			rdata = ip4
+		case typeAAAA:
+			ip6 := a.IP.To16()
+			if ip6 == nil {
+				return nil, fmt.Errorf("mdns: AAAA record %q has no IPv6 address", a.Name)
+			}
+			rdata = ip6
+		case typePTR:
+			name, err := marshalName(a.PTR)
+			if err != nil {
+				return nil, err
+			}
+			rdata = name
+		case typeSRV:
+			if a.SRV == nil {
+				return nil, fmt.Errorf("mdns: SRV record %q has no data", a.Name)
+			}
+			target, err := marshalName(a.SRV.Target)
+			if err != nil {
+				return nil, err
+			}
+			rdata = appendUint16(rdata, a.SRV.Priority)
+			rdata = appendUint16(rdata, a.SRV.Weight)
+			rdata = appendUint16(rdata, a.SRV.Port)
+			rdata = append(rdata, target...)
+		case typeTXT:
+			rdata = marshalTXT(a.TXT)
+		default:
+			return nil, fmt.Errorf("mdns: cannot marshal record type %#x", a.Type)
+		}
+		buf = appendUint16(buf, uint16(len(rdata)))
+		buf = append(buf, rdata...)
+	}
+
+	return buf, nil
+}
+
+// Unmarshal decodes a wire-format mDNS packet into p, replacing any
+// previous contents.
+func (p *packet) Unmarshal(b []byte) error {
+	if len(b) < 12 {
+		return errors.New("mdns: packet too short")
+	}
+
+	p.header = header{
+		id:      binary.BigEndian.Uint16(b[0:2]),
+		flags:   binary.BigEndian.Uint16(b[2:4]),
+		qdCount: binary.BigEndian.Uint16(b[4:6]),
+		anCount: binary.BigEndian.Uint16(b[6:8]),
+		nsCount: binary.BigEndian.Uint16(b[8:10]),
+		arCount: binary.BigEndian.Uint16(b[10:12]),
+	}
+
+	off := 12
+	p.questions = nil
+	p.answers = nil
+
+	for i := 0; i < int(p.header.qdCount); i++ {
+		name, next, err := unmarshalName(b, off)
+		if err != nil {
+			return err
+		}
+		if next+4 > len(b) {
+			return errors.New("mdns: truncated question")
+		}
+		p.questions = append(p.questions, &Question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next : next+2]),
+			Class: binary.BigEndian.Uint16(b[next+2 : next+4]),
+		})
+		off = next + 4
+	}
+
+	for i := 0; i < int(p.header.anCount); i++ {
+		name, next, err := unmarshalName(b, off)
+		if err != nil {
+			return err
+		}
+		if next+10 > len(b) {
+			return errors.New("mdns: truncated answer")
+		}
+		a := &Answer{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next : next+2]),
+			Class: binary.BigEndian.Uint16(b[next+2 : next+4]),
+			TTL:   binary.BigEndian.Uint32(b[next+4 : next+8]),
+		}
+		rdLen := int(binary.BigEndian.Uint16(b[next+8 : next+10]))
+		rdStart := next + 10
+		if rdStart+rdLen > len(b) {
+			return errors.New("mdns: truncated answer data")
+		}
+		rdata := b[rdStart : rdStart+rdLen]
+		switch a.Type {
+		case typeA:
+			if len(rdata) == 4 {
+				a.IP = net.IP(append([]byte(nil), rdata...))
+			}
+		case typeAAAA:
+			if len(rdata) == 16 {
+				a.IP = net.IP(append([]byte(nil), rdata...))
+			}
+		case typePTR:
+			ptr, _, err := unmarshalName(b, rdStart)
+			if err != nil {
+				return err
+			}
+			a.PTR = ptr
+		case typeSRV:
+			if len(rdata) < 6 {
+				return errors.New("mdns: truncated SRV record")
+			}
+			target, _, err := unmarshalName(b, rdStart+6)
+			if err != nil {
+				return err
+			}
+			a.SRV = &SRVRecord{
+				Priority: binary.BigEndian.Uint16(rdata[0:2]),
+				Weight:   binary.BigEndian.Uint16(rdata[2:4]),
+				Port:     binary.BigEndian.Uint16(rdata[4:6]),
+				Target:   target,
+			}
+		case typeTXT:
+			a.TXT = unmarshalTXT(rdata)
+		}
+		off = rdStart + rdLen
+		p.answers = append(p.answers, a)
+	}
+
+	return nil
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// marshalTXT encodes each entry as its own length-prefixed character
+// string, per RFC 6763 section 6.
+func marshalTXT(txt []string) []byte {
+	var buf []byte
+	for _, s := range txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		buf = append(buf, byte(len(s)))
+		buf = append(buf, s...)
+	}
+	return buf
+}
+
+func unmarshalTXT(rdata []byte) []string {
+	var txt []string
+	for off := 0; off < len(rdata); {
+		length := int(rdata[off])
+		off++
+		if off+length > len(rdata) {
+			break
+		}
+		txt = append(txt, string(rdata[off:off+length]))
+		off += length
+	}
+	return txt
+}
+
+func marshalName(name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	var buf []byte
+	for _, label := range strings.Split(name, ".") {
+		if len(label) > 63 {
+			return nil, fmt.Errorf("mdns: label %q exceeds 63 bytes", label)
+		}
+		buf = append(buf, byte(len(label)))
+		buf = append(buf, label...)
+	}
+	return append(buf, 0), nil
+}
+
+// unmarshalName decodes the name starting at off, following compression
+// pointers (RFC 1035 section 4.1.4). It returns the decoded name and the offset
+// of the byte immediately following the name as it appears at off (i.e.
+// after following any pointer, not after the jump target).
+func unmarshalName(b []byte, off int) (string, int, error) {
+	var labels []string
+	origOff := off
+	end := -1
+
+	for {
+		if off >= len(b) {
+			return "", 0, errors.New("mdns: name runs past end of packet")
+		}
+		length := int(b[off])
+		switch {
+		case length == 0:
+			off++
+			if end == -1 {
+				end = off
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case length&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errors.New("mdns: truncated name pointer")
+			}
+			if end == -1 {
+				end = off + 2
+			}
+			pointer := int(binary.BigEndian.Uint16(b[off:off+2]) &^ 0xc000)
+			if pointer >= origOff {
+				return "", 0, errors.New("mdns: name pointer does not point backward")
+			}
+			off = pointer
+			origOff = pointer
+		default:
+			off++
+			if off+length > len(b) {
+				return "", 0, errors.New("mdns: truncated label")
+			}
+			labels = append(labels, string(b[off:off+length]))
+			off += length
+		}
+	}
+}
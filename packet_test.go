@@ -0,0 +1,179 @@
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestPacketMarshalUnmarshalRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		pkt  packet
+	}{
+		{
+			name: "A",
+			pkt: packet{
+				questions: []*Question{{Name: "host.local.", Type: typeA, Class: classIN}},
+				answers: []*Answer{
+					{Name: "host.local.", Type: typeA, Class: classIN, TTL: defaultAnswerTTL, IP: net.IPv4(192, 0, 2, 1).To4()},
+				},
+			},
+		},
+		{
+			name: "AAAA",
+			pkt: packet{
+				answers: []*Answer{
+					{Name: "host.local.", Type: typeAAAA, Class: classIN, TTL: defaultAnswerTTL, IP: net.ParseIP("2001:db8::1")},
+				},
+			},
+		},
+		{
+			name: "PTR",
+			pkt: packet{
+				answers: []*Answer{
+					{Name: "_http._tcp.local.", Type: typePTR, Class: classIN, TTL: defaultServiceTTL, PTR: "My Printer._http._tcp.local."},
+				},
+			},
+		},
+		{
+			name: "SRV",
+			pkt: packet{
+				answers: []*Answer{
+					{Name: "My Printer._http._tcp.local.", Type: typeSRV, Class: classIN, TTL: defaultServiceTTL, SRV: &SRVRecord{Port: 8080, Target: "host.local."}},
+				},
+			},
+		},
+		{
+			name: "TXT",
+			pkt: packet{
+				answers: []*Answer{
+					{Name: "My Printer._http._tcp.local.", Type: typeTXT, Class: classIN, TTL: defaultServiceTTL, TXT: []string{"path=/", "version=1"}},
+				},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			raw, err := tc.pkt.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+
+			var got packet
+			if err := got.Unmarshal(raw); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+
+			if len(got.questions) != len(tc.pkt.questions) {
+				t.Fatalf("questions: got %d, want %d", len(got.questions), len(tc.pkt.questions))
+			}
+			for i, q := range tc.pkt.questions {
+				if *got.questions[i] != *q {
+					t.Errorf("question %d: got %+v, want %+v", i, got.questions[i], q)
+				}
+			}
+
+			if len(got.answers) != len(tc.pkt.answers) {
+				t.Fatalf("answers: got %d, want %d", len(got.answers), len(tc.pkt.answers))
+			}
+			for i, want := range tc.pkt.answers {
+				got := got.answers[i]
+				if got.Name != want.Name || got.Type != want.Type || got.Class != want.Class || got.TTL != want.TTL {
+					t.Errorf("answer %d: got %+v, want %+v", i, got, want)
+				}
+				switch want.Type {
+				case typeA, typeAAAA:
+					if !got.IP.Equal(want.IP) {
+						t.Errorf("answer %d IP: got %v, want %v", i, got.IP, want.IP)
+					}
+				case typePTR:
+					if got.PTR != want.PTR {
+						t.Errorf("answer %d PTR: got %q, want %q", i, got.PTR, want.PTR)
+					}
+				case typeSRV:
+					if got.SRV == nil || *got.SRV != *want.SRV {
+						t.Errorf("answer %d SRV: got %+v, want %+v", i, got.SRV, want.SRV)
+					}
+				case typeTXT:
+					if !reflect.DeepEqual(got.TXT, want.TXT) {
+						t.Errorf("answer %d TXT: got %v, want %v", i, got.TXT, want.TXT)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestUnmarshalCompressedName hand-builds a packet whose second record's
+// name is a compression pointer back at the first, since Marshal never
+// emits pointers itself.
+func TestUnmarshalCompressedName(t *testing.T) {
+	name, err := marshalName("host.local.")
+	if err != nil {
+		t.Fatalf("marshalName: %v", err)
+	}
+
+	var buf []byte
+	buf = appendUint16(buf, 0) // id
+	buf = appendUint16(buf, 0) // flags
+	buf = appendUint16(buf, 0) // qdcount
+	buf = appendUint16(buf, 2) // ancount
+	buf = appendUint16(buf, 0) // nscount
+	buf = appendUint16(buf, 0) // arcount
+
+	nameOff := len(buf)
+	buf = append(buf, name...)
+	buf = appendUint16(buf, typeA)
+	buf = appendUint16(buf, classIN)
+	buf = appendUint32(buf, defaultAnswerTTL)
+	ip := net.IPv4(192, 0, 2, 1).To4()
+	buf = appendUint16(buf, uint16(len(ip)))
+	buf = append(buf, ip...)
+
+	buf = append(buf, 0xc0|byte(nameOff>>8), byte(nameOff))
+	buf = appendUint16(buf, typeA)
+	buf = appendUint16(buf, classIN)
+	buf = appendUint32(buf, defaultAnswerTTL)
+	buf = appendUint16(buf, uint16(len(ip)))
+	buf = append(buf, ip...)
+
+	var pkt packet
+	if err := pkt.Unmarshal(buf); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(pkt.answers) != 2 {
+		t.Fatalf("answers: got %d, want 2", len(pkt.answers))
+	}
+	if pkt.answers[1].Name != "host.local." {
+		t.Errorf("compressed answer name: got %q, want %q", pkt.answers[1].Name, "host.local.")
+	}
+}
+
+func TestUnmarshalTruncated(t *testing.T) {
+	cases := []struct {
+		name string
+		b    []byte
+	}{
+		{"too short", []byte{0, 1, 2}},
+		{"truncated question", func() []byte {
+			var buf []byte
+			buf = appendUint16(buf, 0)
+			buf = appendUint16(buf, 0)
+			buf = appendUint16(buf, 1)
+			buf = appendUint16(buf, 0)
+			buf = appendUint16(buf, 0)
+			buf = appendUint16(buf, 0)
+			return append(buf, 3, 'f', 'o', 'o')
+		}()},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var pkt packet
+			if err := pkt.Unmarshal(tc.b); err == nil {
+				t.Fatal("Unmarshal: want error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package mdns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// service is a DNS-SD service instance registered via RegisterService.
+type service struct {
+	instance string
+	service  string
+	port     uint16
+	txt      []string
+}
+
+func (s *service) fqdn() string {
+	return s.instance + "." + s.service
+}
+
+// RegisterService makes Conn answer PTR/SRV/TXT queries for a DNS-SD
+// service instance, e.g.:
+//
+//	c.RegisterService("My Printer", "_http._tcp.local.", 8080, []string{"path=/"})
+func (c *Conn) RegisterService(instance, serviceName string, port uint16, txt []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.services = append(c.services, service{
+		instance: instance,
+		service:  serviceName,
+		port:     port,
+		txt:      append([]string(nil), txt...),
+	})
+}
+
+// ServiceEntry describes a single DNS-SD service instance discovered by
+// QueryService. An entry is only delivered once it has collected an
+// address, a port and a TXT record.
+type ServiceEntry struct {
+	Name   string
+	Host   string
+	AddrV4 net.IP
+	AddrV6 net.IP
+	Port   uint16
+	TXT    []string
+	TTL    uint32
+}
+
+func (e *ServiceEntry) complete() bool {
+	return e.Port != 0 && (e.AddrV4 != nil || e.AddrV6 != nil) && e.TXT != nil
+}
+
+// subscribePTR registers a channel that receives every PTR answer for
+// service seen by start(), and returns a function that unregisters it.
+func (c *Conn) subscribePTR(serviceName string) (chan *Answer, func()) {
+	ch := make(chan *Answer, 8)
+
+	c.mu.Lock()
+	c.serviceQueries[serviceName] = append(c.serviceQueries[serviceName], ch)
+	c.mu.Unlock()
+
+	cancel := func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		subs := c.serviceQueries[serviceName]
+		for i, sub := range subs {
+			if sub == ch {
+				c.serviceQueries[serviceName] = append(subs[:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+	return ch, cancel
+}
+
+// QueryService issues a PTR query for serviceName (e.g.
+// "_http._tcp.local.") and, for every instance it discovers, follows up
+// with SRV/TXT/A/AAAA queries. Every instance already cached from an
+// earlier lookup is consulted immediately. Completed entries are
+// streamed on the returned channel until ctx is canceled or expires, at
+// which point the channel is closed.
+func (c *Conn) QueryService(ctx context.Context, serviceName string) <-chan ServiceEntry {
+	entries := make(chan ServiceEntry)
+	ptrChan, cancel := c.subscribePTR(serviceName)
+
+	sendPTRQuery := func() {
+		query := packet{
+			questions: []*Question{
+				{Name: serviceName, Type: typePTR, Class: classIN},
+			},
+		}
+		raw, err := query.Marshal()
+		if err != nil {
+			return
+		}
+		c.writeAll(raw)
+	}
+
+	go func() {
+		defer close(entries)
+		defer cancel()
+
+		seen := map[string]bool{}
+		var wg sync.WaitGroup
+		defer wg.Wait()
+
+		handlePTR := func(a *Answer) {
+			if a.PTR == "" || seen[a.PTR] {
+				return
+			}
+			seen[a.PTR] = true
+
+			wg.Add(1)
+			go func(instance string, ttl uint32) {
+				defer wg.Done()
+				c.resolveInstance(ctx, instance, ttl, entries)
+			}(a.PTR, a.TTL)
+		}
+
+		ticker := time.NewTicker(c.queryInterval)
+		defer ticker.Stop()
+
+		c.mu.RLock()
+		cached := c.cachePTRGet(serviceName)
+		c.mu.RUnlock()
+		for i := range cached {
+			handlePTR(&cached[i])
+		}
+
+		sendPTRQuery()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.closed:
+				return
+			case <-ticker.C:
+				sendPTRQuery()
+			case a := <-ptrChan:
+				handlePTR(a)
+			}
+		}
+	}()
+
+	return entries
+}
+
+// resolveInstance follows up a discovered PTR instance with SRV, TXT
+// and A/AAAA queries, delivering entries on entries once complete.
+func (c *Conn) resolveInstance(ctx context.Context, instance string, ttl uint32, entries chan<- ServiceEntry) {
+	entry := ServiceEntry{Name: instance, TTL: ttl}
+
+	if srv := c.queryRecord(ctx, instance, typeSRV); srv != nil && srv.SRV != nil {
+		entry.Host = srv.SRV.Target
+		entry.Port = srv.SRV.Port
+	}
+	if txt := c.queryRecord(ctx, instance, typeTXT); txt != nil {
+		entry.TXT = txt.TXT
+		if entry.TXT == nil {
+			// A TXT record with no strings still counts as collected.
+			entry.TXT = []string{}
+		}
+	}
+	if entry.Host != "" {
+		if a := c.queryRecord(ctx, entry.Host, typeA); a != nil {
+			entry.AddrV4 = a.IP
+		}
+		if aaaa := c.queryRecord(ctx, entry.Host, typeAAAA); aaaa != nil {
+			entry.AddrV6 = aaaa.IP
+		}
+	}
+
+	if !entry.complete() {
+		return
+	}
+	select {
+	case entries <- entry:
+	case <-ctx.Done():
+	}
+}
+
+// queryRecord is queryType, but discards the answer if it isn't of the
+// requested type.
+func (c *Conn) queryRecord(ctx context.Context, name string, recordType uint16) *Answer {
+	answer, _ := c.queryType(ctx, name, recordType)
+	if answer.Type != recordType {
+		return nil
+	}
+	return &answer
+}